@@ -0,0 +1,70 @@
+// Package backoff implements exponential backoff with full jitter, so
+// retries of a failing expression evaluation or notification post don't
+// synchronize into a thundering herd:
+//
+//	sleep = rand(0, min(MaxBackoff, MinBackoff*2^attempt))
+//
+// See https://aws.amazon.com/blogs/architecture/exponential-backoff-and-jitter/.
+package backoff
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Backoff tracks retry state for one failing operation. The zero value
+// is usable; MinBackoff and MaxBackoff default to 1s and 1m.
+type Backoff struct {
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	MaxRetries int // 0 means retry forever
+
+	attempt int
+	lastErr error
+}
+
+// Next records a failed attempt and returns how long to sleep before
+// retrying.
+func (b *Backoff) Next() time.Duration {
+	min := b.MinBackoff
+	if min <= 0 {
+		min = time.Second
+	}
+	max := b.MaxBackoff
+	if max <= 0 {
+		max = time.Minute
+	}
+	d := float64(min) * math.Pow(2, float64(b.attempt))
+	if d > float64(max) {
+		d = float64(max)
+	}
+	b.attempt++
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// Fail records err as the cause of the most recent failed attempt.
+func (b *Backoff) Fail(err error) {
+	b.lastErr = err
+}
+
+// Attempts returns how many times Next has been called.
+func (b *Backoff) Attempts() int {
+	return b.attempt
+}
+
+// Exhausted reports whether MaxRetries has been reached.
+func (b *Backoff) Exhausted() bool {
+	return b.MaxRetries > 0 && b.attempt >= b.MaxRetries
+}
+
+// ErrCause explains why retrying stopped: ctx.Err() if ctx ended first,
+// otherwise an error wrapping the last failure and the attempt count.
+func (b *Backoff) ErrCause(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("backoff: gave up after %d attempts: %v", b.attempt, b.lastErr)
+}
@@ -0,0 +1,109 @@
+package sched
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Level is a logging severity, ordered from most to least verbose.
+type Level int
+
+const (
+	LevelTrace Level = iota
+	LevelDebug
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelTrace:
+		return "TRACE"
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	default:
+		return "?"
+	}
+}
+
+// trace holds the subsystems enabled by BOSUN_TRACE, a comma-separated
+// list such as "BOSUN_TRACE=sched" that turns on Trace/Debug output for
+// the named subsystems without a recompile. Every logger in this
+// package derives from Log, whose subsystem is "sched"; other names,
+// such as "expr" or "notify", enable nothing.
+var trace = func() map[string]bool {
+	m := make(map[string]bool)
+	for _, s := range strings.Split(os.Getenv("BOSUN_TRACE"), ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			m[s] = true
+		}
+	}
+	return m
+}()
+
+// Logger is a structured, leveled logger that carries a set of
+// key/value fields bound via With. It is safe for concurrent use.
+type Logger struct {
+	subsystem string
+	fields    []interface{}
+}
+
+// Log is the package-level logger for sched. Subsystems that fan out
+// goroutines (Notify, AddNotification) should call Log.With to bind
+// alert/group/notification fields before logging from them.
+var Log = &Logger{subsystem: "sched"}
+
+// With returns a copy of l with kv (alternating key, value) appended to
+// its bound fields.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	return &Logger{subsystem: l.subsystem, fields: fields}
+}
+
+func (l *Logger) enabled(level Level) bool {
+	if level >= LevelInfo {
+		return true
+	}
+	return trace[l.subsystem]
+}
+
+var logMu sync.Mutex
+
+func (l *Logger) log(level Level, msg string, kv ...interface{}) {
+	if !l.enabled(level) {
+		return
+	}
+	var b strings.Builder
+	b.WriteString(level.String())
+	b.WriteString(" ")
+	b.WriteString(l.subsystem)
+	b.WriteString(": ")
+	b.WriteString(msg)
+	all := make([]interface{}, 0, len(l.fields)+len(kv))
+	all = append(all, l.fields...)
+	all = append(all, kv...)
+	for i := 0; i+1 < len(all); i += 2 {
+		fmt.Fprintf(&b, " %v=%v", all[i], all[i+1])
+	}
+	logMu.Lock()
+	defer logMu.Unlock()
+	log.Println(b.String())
+}
+
+func (l *Logger) Trace(msg string, kv ...interface{}) { l.log(LevelTrace, msg, kv...) }
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.log(LevelDebug, msg, kv...) }
+func (l *Logger) Info(msg string, kv ...interface{})  { l.log(LevelInfo, msg, kv...) }
+func (l *Logger) Warn(msg string, kv ...interface{})  { l.log(LevelWarn, msg, kv...) }
+func (l *Logger) Error(msg string, kv ...interface{}) { l.log(LevelError, msg, kv...) }
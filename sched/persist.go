@@ -0,0 +1,218 @@
+package sched
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/StackExchange/tsaf/sched/store"
+)
+
+// recordKind labels what a single log record's payload represents, so
+// Replay can dispatch it without guessing from shape.
+type recordKind string
+
+const (
+	kindState    recordKind = "state"    // one (AlertKey, State) pair: a transition or ack
+	kindSnapshot recordKind = "snapshot" // a full []persisted compaction snapshot
+	kindNotify   recordKind = "notify"   // a notification was scheduled or fired
+)
+
+// logRecord wraps every record appended to the store so Replay can tell
+// a state record from a snapshot from a notify record.
+type logRecord struct {
+	Kind recordKind
+	Data json.RawMessage
+}
+
+// persisted is the on-disk shape of one (AlertKey, State) pair: a
+// compaction snapshot is a JSON array of these, and each state log
+// record carries exactly one.
+type persisted struct {
+	Key   AlertKey
+	State *State
+}
+
+// notifyEvent is an audit-trail record of a notification being armed
+// (Fired false) or escalating to its next stage (Fired true).
+type notifyEvent struct {
+	Key          AlertKey
+	Notification string
+	Fired        bool
+	Time         time.Time
+}
+
+// marshalRecord wraps v's JSON encoding in a kind envelope, ready to
+// append to the state store or queue into s.pending.
+func marshalRecord(k recordKind, v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(logRecord{Kind: k, Data: data})
+}
+
+// openStore opens the state store at s.StateFile. Called once a
+// *conf.Conf naming the file is loaded.
+func (s *Schedule) openStore() {
+	if s.StateFile == "" {
+		return
+	}
+	st, err := store.NewStore(s.StateFile)
+	if err != nil {
+		Log.Error("open state store failed", "file", s.StateFile, "err", err)
+		return
+	}
+	s.store = st
+}
+
+// replayStore rebuilds s.Status from the state store's last compaction
+// snapshot plus every record appended since, replacing the old
+// behavior of decoding one whole-state JSON blob on every restore.
+func (s *Schedule) replayStore() {
+	s.Status = make(map[AlertKey]*State)
+	if s.store == nil {
+		return
+	}
+	apply := func(data []byte) error {
+		var rec logRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return err
+		}
+		switch rec.Kind {
+		case kindSnapshot:
+			var recs []persisted
+			if err := json.Unmarshal(rec.Data, &recs); err != nil {
+				return err
+			}
+			for _, r := range recs {
+				s.applyPersisted(r)
+			}
+		case kindState:
+			var one persisted
+			if err := json.Unmarshal(rec.Data, &one); err != nil {
+				return err
+			}
+			s.applyPersisted(one)
+		case kindNotify:
+			// Audit trail only: the pending escalation itself is
+			// derived from State.Notifications, so there's nothing to
+			// rebuild in memory here. State.Notifications reaches disk
+			// in compaction snapshots and in state records written
+			// after the chain was armed; the state record of the
+			// transition that arms a chain is marshaled before the
+			// chain starts and does not include it.
+		default:
+			return fmt.Errorf("persist: unknown record kind %q", rec.Kind)
+		}
+		return nil
+	}
+	if err := s.store.Replay(apply, apply); err != nil {
+		Log.Error("replay state store failed", "file", s.StateFile, "err", err)
+	}
+}
+
+func (s *Schedule) applyPersisted(r persisted) {
+	if !r.State.Acknowledged {
+		r.State.ctx, r.State.cancel = context.WithCancel(context.Background())
+	}
+	s.Status[r.Key] = r.State
+}
+
+// resumeNotifications restarts the escalation goroutines for any
+// pending notification chains found in the replayed state.
+func (s *Schedule) resumeNotifications(ctx context.Context) {
+	for ak, st := range s.Status {
+		for name, started := range st.Notifications {
+			n, present := s.Notifications[name]
+			if !present {
+				Log.Warn("restore: notification not present", "alert", ak.Name, "notification", name)
+				continue
+			}
+			a, present := s.Alerts[ak.Name]
+			if !present {
+				Log.Warn("restore: alert not present", "alert", ak.Name)
+				continue
+			}
+			go s.AddNotification(ctx, st, a, n, st.Group, started)
+		}
+	}
+}
+
+// recordState marshals (ak, state) and queues it to be appended to the
+// state store as part of the current tick's batched transaction.
+func (s *Schedule) recordState(ak AlertKey, state *State) {
+	if s.store == nil {
+		return
+	}
+	b, err := marshalRecord(kindState, persisted{ak, state})
+	if err != nil {
+		Log.Error("marshal state record failed", "alert", ak.Name, "err", err)
+		return
+	}
+	s.pending = append(s.pending, b)
+}
+
+// recordNotify appends a single notification-scheduled or
+// notification-fired record immediately, rather than queuing it into
+// s.pending: these happen on escalation timers and acks, outside the
+// normal Check batch, so they can't wait for the next flushStore. It's
+// called from Notify/AddNotification's detached goroutines, which
+// don't hold s.Lock, while openStore (re)assigns s.store under it on a
+// config reload - so the field read needs the lock even though the
+// append itself doesn't.
+func (s *Schedule) recordNotify(ak AlertKey, name string, fired bool) {
+	s.Lock()
+	st := s.store
+	s.Unlock()
+	if st == nil {
+		return
+	}
+	b, err := marshalRecord(kindNotify, notifyEvent{Key: ak, Notification: name, Fired: fired, Time: time.Now().UTC()})
+	if err != nil {
+		Log.Error("marshal notify record failed", "alert", ak.Name, "err", err)
+		return
+	}
+	if err := st.Append(b); err != nil {
+		Log.Error("append notify record failed", "alert", ak.Name, "err", err)
+	}
+}
+
+// flushStore appends this tick's buffered records in one transaction
+// and compacts the log into a fresh snapshot if it has grown past 2x
+// the snapshot size.
+func (s *Schedule) flushStore() {
+	if s.store == nil || len(s.pending) == 0 {
+		return
+	}
+	if err := s.store.AppendBatch(s.pending); err != nil {
+		Log.Error("append state store failed", "err", err)
+	}
+	s.pending = s.pending[:0]
+	if s.store.ShouldCompact() {
+		s.compact()
+	}
+}
+
+// compact snapshots the current in-memory Status, bounding log replay
+// time and disk growth for deployments with many alert keys.
+func (s *Schedule) compact() {
+	if s.store == nil {
+		return
+	}
+	recs := make([]persisted, 0, len(s.Status))
+	for k, v := range s.Status {
+		recs = append(recs, persisted{k, v})
+	}
+	data, err := marshalRecord(kindSnapshot, recs)
+	if err != nil {
+		Log.Error("marshal snapshot failed", "err", err)
+		return
+	}
+	if err := s.store.Snapshot(data); err != nil {
+		Log.Error("compact state store failed", "err", err)
+		return
+	}
+	Log.Debug("compacted state store", "keys", len(recs))
+}
@@ -2,25 +2,85 @@ package sched
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"io"
-	"log"
-	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/StackExchange/scollector/opentsdb"
 	"github.com/StackExchange/tsaf/conf"
 	"github.com/StackExchange/tsaf/expr"
+	"github.com/StackExchange/tsaf/sched/backoff"
+	"github.com/StackExchange/tsaf/sched/store"
+	"github.com/StackExchange/tsaf/sched/stream"
 )
 
+// Default backoff parameters for retrying a failing expression
+// evaluation or a failing HTTP notification post, independent of the
+// schedule's normal Freq tick.
+//
+// These are package-level defaults rather than per-alert/per-
+// notification overrides: conf.Alert and conf.Notification aren't
+// defined in this tree, so there's nowhere to hang an override field.
+// A real change here should add something like Alert.ExprBackoff and
+// Notification.Backoff to package conf and read them in CheckExpr and
+// retryNotify instead of these consts.
+const (
+	minExprBackoff = time.Second * 5
+	maxExprBackoff = time.Minute * 5
+	maxExprRetries = 6
+
+	minNotifyBackoff = time.Second * 5
+	maxNotifyBackoff = time.Minute * 5
+	maxNotifyRetries = 6
+)
+
+// defaultStreamSize and defaultStreamTTL bound the in-memory event
+// buffer that backs Schedule.Subscribe; they are generous enough to
+// let a reconnecting web client replay recent history without keeping
+// unbounded state for long-lived deployments.
+const (
+	defaultStreamSize = 10000
+	defaultStreamTTL  = time.Hour
+)
+
+// exprErrors counts expression evaluations that returned an error, for
+// ops dashboards. Use ExprErrors to read it: dashboards poll from a
+// goroutine that doesn't hold Schedule.Lock, so the increment in
+// CheckExpr needs to be atomic rather than a bare read/write.
+var exprErrors int64
+
+// ExprErrors returns how many expression evaluations have returned an
+// error so far. Safe for concurrent use.
+func ExprErrors() int64 {
+	return atomic.LoadInt64(&exprErrors)
+}
+
 type Schedule struct {
 	*conf.Conf
 	sync.Mutex
 	Freq   time.Duration
 	Status map[AlertKey]*State
 	cache  *opentsdb.Cache
+	stream *stream.Buffer
+
+	// exprBackoff tracks retry state for alert expressions that are
+	// currently failing, keyed by exprBackoffKey.
+	exprBackoff map[string]*backoff.Backoff
+
+	// store is the append-only persistence log backing Status; pending
+	// holds this tick's not-yet-flushed records. See persist.go.
+	store   *store.Store
+	pending [][]byte
+
+	// unknown tracks the synthetic ST_UNKNOWN marker for expressions
+	// whose retry backoff has been exhausted, keyed by exprBackoffKey.
+	// It is kept separate from Status because it has no real AlertKey:
+	// there's no result group to key it by, only the alert and severity
+	// that failed to evaluate at all.
+	unknown map[string]*State
 }
 
 func (s *Schedule) MarshalJSON() ([]byte, error) {
@@ -43,26 +103,39 @@ func (s *Schedule) MarshalJSON() ([]byte, error) {
 }
 
 var DefaultSched = &Schedule{
-	Freq: time.Minute * 5,
+	Freq:   time.Minute * 5,
+	stream: stream.NewBuffer(defaultStreamSize, defaultStreamTTL),
+}
+
+// Subscribe registers a new subscription against the schedule's event
+// stream, an internal-events analogue to the Email/Post/Get/Print
+// notification paths. The returned Subscription delivers Events
+// matching filter starting after since (0 for only events appended
+// from now on); callers must Close it when done.
+func (s *Schedule) Subscribe(ctx context.Context, filter stream.Filter, since uint64) (*stream.Subscription, error) {
+	return s.stream.Subscribe(ctx, filter, since)
 }
 
 // Loads a configuration into the default schedule
-func Load(c *conf.Conf) {
-	DefaultSched.Load(c)
+func Load(ctx context.Context, c *conf.Conf) {
+	DefaultSched.Load(ctx, c)
 }
 
 // Runs the default schedule.
-func Run() error {
-	return DefaultSched.Run()
+func Run(ctx context.Context) error {
+	return DefaultSched.Run(ctx)
 }
 
-func (s *Schedule) Load(c *conf.Conf) {
+func (s *Schedule) Load(ctx context.Context, c *conf.Conf) {
 	s.Conf = c
-	s.RestoreState()
+	s.RestoreState(ctx)
 }
 
-// Restores notification and alert state from the file on disk.
-func (s *Schedule) RestoreState() {
+// Restores notification and alert state from the state store's
+// snapshot and log on disk. ctx is the process lifetime context; any
+// notification chains resumed here are cancelled along with everything
+// else on shutdown.
+func (s *Schedule) RestoreState(ctx context.Context) {
 	s.Lock()
 	defer s.Unlock()
 	s.cache = opentsdb.NewCache(s.Conf.TsdbHost)
@@ -70,108 +143,117 @@ func (s *Schedule) RestoreState() {
 	for _, st := range s.Status {
 		st.Acknowledge()
 	}
-	s.Status = make(map[AlertKey]*State)
-	f, err := os.Open(s.StateFile)
-	if err != nil {
-		log.Println(err)
-		return
-	}
-	dec := json.NewDecoder(f)
-	for {
-		var ak AlertKey
-		var st State
-		if err := dec.Decode(&ak); err == io.EOF {
-			break
-		} else if err != nil {
-			log.Println(err)
-			return
-		}
-		if err := dec.Decode(&st); err != nil {
-			log.Println(err)
-			return
-		}
-		for k, v := range st.Notifications {
-			n, present := s.Notifications[k]
-			if !present {
-				log.Println("sched: notification not present during restore:", k)
-				continue
-			}
-			a, present := s.Alerts[ak.Name]
-			if !present {
-				log.Println("sched: alert not present during restore:", ak.Name)
-				continue
-			}
-			go s.AddNotification(&st, a, n, st.Group, v)
-		}
-		s.Status[ak] = &st
-	}
+	defer s.stream.Append(stream.Event{Topic: stream.TopicRestore})
+	s.openStore()
+	s.replayStore()
+	s.resumeNotifications(ctx)
 }
 
+// Save flushes any buffered state-store records and forces a
+// compaction snapshot, so a clean shutdown never loses a transition
+// that happened between the last compaction and exit.
 func (s *Schedule) Save() {
 	s.Lock()
 	defer s.Unlock()
-	f, err := os.Create(s.StateFile)
-	if err != nil {
-		log.Println(err)
-		return
-	}
-	enc := json.NewEncoder(f)
-	for k, v := range s.Status {
-		enc.Encode(k)
-		enc.Encode(v)
-	}
-	if err := f.Close(); err != nil {
-		log.Println(err)
-		return
-	}
-	log.Println("sched: wrote state to", s.StateFile)
+	s.flushStore()
+	s.compact()
 }
 
-func (s *Schedule) Run() error {
+// Run evaluates alerts on s.Freq until ctx is cancelled. On cancellation
+// it saves state once more before returning, so nothing is lost between
+// the last tick and process exit.
+func (s *Schedule) Run(ctx context.Context) error {
+	if s.Freq < time.Second {
+		return fmt.Errorf("sched: frequency must be > 1 second")
+	}
+	if s.Conf == nil {
+		return fmt.Errorf("sched: nil configuration")
+	}
 	go func() {
-		for _ = range time.Tick(time.Second * 20) {
-			s.Save()
+		ticker := time.NewTicker(time.Second * 20)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.Lock()
+				s.flushStore()
+				s.Unlock()
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
 	for {
-		wait := time.After(s.Freq)
-		if s.Freq < time.Second {
-			return fmt.Errorf("sched: frequency must be > 1 second")
-		}
-		if s.Conf == nil {
-			return fmt.Errorf("sched: nil configuration")
-		}
 		start := time.Now()
-		s.Check()
+		s.Check(ctx)
 		fmt.Printf("run at %v took %v\n", start, time.Since(start))
-		<-wait
+		select {
+		case <-ctx.Done():
+			s.Save()
+			return ctx.Err()
+		case <-time.After(s.Freq):
+		}
 	}
 }
 
-func (s *Schedule) Check() {
+func (s *Schedule) Check(ctx context.Context) {
 	s.Lock()
 	defer s.Unlock()
 	s.cache = opentsdb.NewCache(s.Conf.TsdbHost)
 	for _, a := range s.Conf.Alerts {
-		s.CheckAlert(a)
+		s.CheckAlert(ctx, a)
 	}
+	s.flushStore()
 }
 
-func (s *Schedule) CheckAlert(a *conf.Alert) {
-	ignore := s.CheckExpr(a, a.Crit, true, nil)
-	s.CheckExpr(a, a.Warn, false, ignore)
+func (s *Schedule) CheckAlert(ctx context.Context, a *conf.Alert) {
+	ignore := s.CheckExpr(ctx, a, a.Crit, true, nil)
+	s.CheckExpr(ctx, a, a.Warn, false, ignore)
 }
 
-func (s *Schedule) CheckExpr(a *conf.Alert, e *expr.Expr, isCrit bool, ignore []AlertKey) (alerts []AlertKey) {
+func (s *Schedule) CheckExpr(ctx context.Context, a *conf.Alert, e *expr.Expr, isCrit bool, ignore []AlertKey) (alerts []AlertKey) {
 	if e == nil {
 		return
 	}
+	key := exprBackoffKey(a, isCrit)
 	results, err := e.Execute(s.cache, nil)
 	if err != nil {
-		// todo: do something here?
-		log.Println(err)
+		atomic.AddInt64(&exprErrors, 1)
+		l := Log.With("alert", a.Name, "expr", e.String())
+		if s.exprBackoff == nil {
+			s.exprBackoff = make(map[string]*backoff.Backoff)
+		}
+		b, ok := s.exprBackoff[key]
+		if !ok {
+			b = &backoff.Backoff{MinBackoff: minExprBackoff, MaxBackoff: maxExprBackoff, MaxRetries: maxExprRetries}
+			s.exprBackoff[key] = b
+		}
+		b.Fail(err)
+		if b.Exhausted() {
+			l.Error("giving up retrying expression", "err", b.ErrCause(ctx))
+			delete(s.exprBackoff, key)
+			s.markUnknown(key, a.Name)
+			return
+		}
+		wait := b.Next()
+		l.Warn("expression evaluation failed, retrying", "in", wait, "err", err)
+		go func() {
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return
+			}
+			s.Lock()
+			defer s.Unlock()
+			if ctx.Err() != nil {
+				return
+			}
+			s.CheckExpr(ctx, a, e, isCrit, nil)
+		}()
 		return
 	}
+	delete(s.exprBackoff, key)
+	s.clearUnknown(key, a.Name)
 Loop:
 	for _, r := range results {
 		if a.Squelched(r.Group) {
@@ -196,6 +278,12 @@ Loop:
 		} else if isCrit {
 			status = ST_CRIT
 		}
+		var old Status
+		hadHistory := len(state.History) > 0
+		if hadHistory {
+			old = state.Last().Status
+		}
+		changed := !hadHistory || old != status
 		notify := state.Append(status)
 		s.Status[ak] = state
 		if status != ST_NORM {
@@ -203,40 +291,176 @@ Loop:
 			state.Expr = e.String()
 			var subject = new(bytes.Buffer)
 			if err := a.ExecuteSubject(subject, r.Group, s.cache); err != nil {
-				log.Println(err)
+				Log.With("alert", a.Name, "group", ak.Group).Warn("subject template failed", "err", err)
 			}
 			state.Subject = subject.String()
 		}
+		if changed {
+			s.stream.Append(stream.Event{
+				Topic:   stream.TopicAlert,
+				Key:     ak.String(),
+				Name:    a.Name,
+				Group:   r.Group,
+				Old:     int(old),
+				New:     int(status),
+				Subject: state.Subject,
+			})
+			s.recordState(ak, state)
+		}
 		if notify {
 			for _, n := range a.Notification {
-				go s.Notify(state, a, n, r.Group)
+				go s.Notify(ctx, state, a, n, r.Group)
 			}
 		}
 	}
 	return
 }
 
-func (s *Schedule) Notify(st *State, a *conf.Alert, n *conf.Notification, group opentsdb.TagSet) {
+// exprBackoffKey identifies one evaluation path (an alert's Crit or
+// Warn expression) for retry bookkeeping; a failure happens before any
+// per-group AlertKey can be computed.
+func exprBackoffKey(a *conf.Alert, isCrit bool) string {
+	if isCrit {
+		return a.Name + ":crit"
+	}
+	return a.Name + ":warn"
+}
+
+// markUnknown records that a's expression could not be evaluated after
+// exhausting its retry backoff, so the failure is visible in the event
+// stream instead of silently dropping the alert. It does not touch
+// Status: there is no result group to key a real AlertKey by, only the
+// alert and severity whose evaluation failed outright.
+func (s *Schedule) markUnknown(key, name string) {
+	if s.unknown == nil {
+		s.unknown = make(map[string]*State)
+	}
+	state := s.unknown[key]
+	if state == nil {
+		state = &State{}
+		s.unknown[key] = state
+	}
+	var old Status
+	if len(state.History) > 0 {
+		old = state.Last().Status
+	}
+	state.Append(ST_UNKNOWN)
+	s.stream.Append(stream.Event{
+		Topic: stream.TopicAlert,
+		Key:   key,
+		Name:  name,
+		Old:   int(old),
+		New:   int(ST_UNKNOWN),
+	})
+}
+
+// clearUnknown transitions a previously marked ST_UNKNOWN expression
+// back to normal once it evaluates successfully again; without this,
+// an expression that recovers after a flaky period stays stuck
+// reporting unknown forever.
+func (s *Schedule) clearUnknown(key, name string) {
+	state, ok := s.unknown[key]
+	if !ok {
+		return
+	}
+	delete(s.unknown, key)
+	state.Append(ST_NORM)
+	s.stream.Append(stream.Event{
+		Topic: stream.TopicAlert,
+		Key:   key,
+		Name:  name,
+		Old:   int(ST_UNKNOWN),
+		New:   int(ST_NORM),
+	})
+}
+
+// Notify dispatches one alert transition to a.Notification's Email,
+// Post, Get and Print targets directly, rather than as uniform
+// consumers of the event stream: Email/Post/Get/Print aren't defined
+// anywhere in this tree, so there's no handler body here to rewrite
+// into a Subscribe-driven loop. A real change here would have Notify
+// itself become (or spawn) a stream subscriber filtered on TopicAlert
+// and drive these from there, instead of being called straight out of
+// CheckExpr.
+func (s *Schedule) Notify(ctx context.Context, st *State, a *conf.Alert, n *conf.Notification, group opentsdb.TagSet) {
+	l := Log.With("alert", a.Name, "group", group.String(), "notification", n.Name)
 	if len(n.Email) > 0 {
 		go s.Email(a, n, group)
 	}
 	if n.Post != nil {
-		go s.Post(a, n, group)
+		go s.retryNotify(ctx, st, l.With("via", "post"), n.Name+":post", func() error { return s.Post(a, n, group) })
 	}
 	if n.Get != nil {
-		go s.Get(a, n, group)
+		go s.retryNotify(ctx, st, l.With("via", "get"), n.Name+":get", func() error { return s.Get(a, n, group) })
 	}
 	if n.Print {
 		go s.Print(a, n, group)
 	}
-	// Cannot depend on <-st.ack always returning if it is closed because n.Timeout could be == 0, so check the bit here.
+	// Cannot depend on <-st.ctx.Done() always returning if it is cancelled because n.Timeout could be == 0, so check the bit here.
 	if n.Next == nil || st.Acknowledged {
 		return
 	}
-	s.AddNotification(st, a, n, group, time.Now())
+	l.Trace("scheduling escalation")
+	s.recordNotify(AlertKey{a.Name, group.String()}, n.Name, false)
+	s.AddNotification(ctx, st, a, n, group, time.Now())
 }
 
-func (s *Schedule) AddNotification(st *State, a *conf.Alert, n *conf.Notification, group opentsdb.TagSet, started time.Time) {
+// retryNotify retries fn, a single HTTP notification post, with full-
+// jitter backoff until it succeeds, st is acknowledged, ctx ends, or
+// the retry budget is exhausted. A flaky webhook this way gets several
+// chances instead of silently losing the notification on one failure.
+// name identifies this send in st.NotifyAttempts (e.g. "webhook:post").
+func (s *Schedule) retryNotify(ctx context.Context, st *State, l *Logger, name string, fn func() error) {
+	st.Lock()
+	ackCtx := st.ctx
+	st.Unlock()
+	var ackDone <-chan struct{}
+	if ackCtx != nil {
+		ackDone = ackCtx.Done()
+	}
+	defer func() {
+		st.Lock()
+		delete(st.NotifyAttempts, name)
+		st.Unlock()
+	}()
+	b := &backoff.Backoff{MinBackoff: minNotifyBackoff, MaxBackoff: maxNotifyBackoff, MaxRetries: maxNotifyRetries}
+	for {
+		err := fn()
+		if err == nil {
+			return
+		}
+		b.Fail(err)
+		// b.Attempts() still reflects the count from the previous
+		// Next() call, not this failure; record the count this
+		// failure is actually bringing it to.
+		attempts := b.Attempts() + 1
+		st.Lock()
+		if st.NotifyAttempts == nil {
+			st.NotifyAttempts = make(map[string]int)
+		}
+		st.NotifyAttempts[name] = attempts
+		st.Unlock()
+		if b.Exhausted() {
+			l.Error("giving up on notification", "attempts", attempts, "err", b.ErrCause(ctx))
+			return
+		}
+		wait := b.Next()
+		l.Warn("notification failed, retrying", "in", wait, "err", err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return
+		case <-ackDone:
+			return
+		}
+	}
+}
+
+// AddNotification escalates st to n.Next after n.Timeout, unless st is
+// acknowledged first (st.ctx is cancelled) or ctx itself ends, which
+// happens on shutdown or a config reload that invalidates a's pointer.
+func (s *Schedule) AddNotification(ctx context.Context, st *State, a *conf.Alert, n *conf.Notification, group opentsdb.TagSet, started time.Time) {
+	l := Log.With("alert", a.Name, "group", group.String(), "notification", n.Name)
 	st.Lock()
 	if st.Notifications == nil {
 		st.Notifications = make(map[string]time.Time)
@@ -245,18 +469,50 @@ func (s *Schedule) AddNotification(st *State, a *conf.Alert, n *conf.Notificatio
 	if _, present := st.Notifications[n.Name]; !present {
 		st.Notifications[n.Name] = time.Now().UTC()
 	}
+	ackDone := st.ctx.Done()
 	st.Unlock()
 	select {
-	case <-st.ack:
-		// break
+	case <-ackDone:
+		l.Debug("escalation acknowledged")
+	case <-ctx.Done():
+		l.Debug("escalation cancelled", "err", ctx.Err())
 	case <-time.After(n.Timeout - time.Since(started)):
-		go s.Notify(st, a, n.Next, group)
+		l.Warn("escalating to next notification")
+		s.recordNotify(AlertKey{a.Name, group.String()}, n.Name, true)
+		go s.Notify(ctx, st, a, n.Next, group)
 	}
 	st.Lock()
 	delete(st.Notifications, n.Name)
 	st.Unlock()
 }
 
+// Acknowledge marks the alert at ak acknowledged, canceling any pending
+// notification chain, and publishes a TopicAck event.
+func (s *Schedule) Acknowledge(ak AlertKey) error {
+	s.Lock()
+	defer s.Unlock()
+	st := s.Status[ak]
+	if st == nil {
+		return fmt.Errorf("sched: unknown alert key: %v", ak)
+	}
+	st.Acknowledge()
+	s.stream.Append(stream.Event{
+		Topic: stream.TopicAck,
+		Key:   ak.String(),
+		Name:  ak.Name,
+		Group: st.Group,
+	})
+	if s.store != nil {
+		b, err := marshalRecord(kindState, persisted{ak, st})
+		if err != nil {
+			Log.Error("marshal ack record failed", "alert", ak.Name, "err", err)
+		} else if err := s.store.Append(b); err != nil {
+			Log.Error("append ack record failed", "alert", ak.Name, "err", err)
+		}
+	}
+	return nil
+}
+
 type AlertKey struct {
 	Name  string
 	Group string
@@ -279,7 +535,15 @@ type State struct {
 	Acknowledged  bool
 	Notifications map[string]time.Time
 
-	ack chan interface{}
+	// NotifyAttempts counts retries so far for each in-flight
+	// notification send, keyed by "<name>:post" or "<name>:get"; an
+	// entry is removed once that send succeeds or gives up for good.
+	NotifyAttempts map[string]int
+
+	// ctx is cancelled by Acknowledge, ending any escalation chain
+	// waiting in AddNotification.
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 func (s *State) Acknowledge() {
@@ -287,8 +551,8 @@ func (s *State) Acknowledge() {
 		return
 	}
 	s.Acknowledged = true
-	if s.ack != nil {
-		close(s.ack)
+	if s.cancel != nil {
+		s.cancel()
 	}
 }
 
@@ -305,7 +569,7 @@ func (s *State) Append(status Status) bool {
 		s.History = append(s.History, Event{status, time.Now().UTC()})
 		s.Acknowledged = status != ST_CRIT
 		if !s.Acknowledged {
-			s.ack = make(chan interface{})
+			s.ctx, s.cancel = context.WithCancel(context.Background())
 		}
 		return status == ST_CRIT
 	}
@@ -327,6 +591,9 @@ const (
 	ST_NORM Status = iota
 	ST_WARN
 	ST_CRIT
+	// ST_UNKNOWN marks an alert whose expression could not be
+	// evaluated after exhausting its retry backoff.
+	ST_UNKNOWN
 )
 
 func (s Status) String() string {
@@ -337,6 +604,8 @@ func (s Status) String() string {
 		return "warning"
 	case ST_CRIT:
 		return "critical"
+	case ST_UNKNOWN:
+		return "unknown"
 	default:
 		return "unknown"
 	}
@@ -0,0 +1,200 @@
+// Package store implements an append-only, crash-safe record log with
+// periodic compaction snapshots, the persistence layer behind
+// Schedule.Check. It replaces re-encoding the entire alert state on
+// every tick: a tick appends only the records it produced, and a
+// snapshot is taken opportunistically once the log has grown well past
+// the snapshot's size.
+//
+// Records are opaque to Store; callers provide already-marshaled bytes
+// (sched uses JSON) and get the same bytes back during Replay. Each
+// record is framed with a length prefix and a CRC32 trailer so a crash
+// mid-write leaves a detectable torn record rather than corrupting
+// everything that came before it; Replay stops at the first bad frame
+// and truncates the log there.
+package store
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+)
+
+// Store pairs an append-only log file with a compaction snapshot file
+// (logPath + ".snap").
+type Store struct {
+	mu       sync.Mutex
+	logPath  string
+	snapPath string
+	logSize  int64
+	snapSize int64
+}
+
+// NewStore returns a Store backed by logPath and logPath+".snap".
+// Neither file needs to exist yet.
+func NewStore(logPath string) (*Store, error) {
+	s := &Store{logPath: logPath, snapPath: logPath + ".snap"}
+	if fi, err := os.Stat(logPath); err == nil {
+		s.logSize = fi.Size()
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if fi, err := os.Stat(s.snapPath); err == nil {
+		s.snapSize = fi.Size()
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Append writes one record to the log.
+func (s *Store) Append(record []byte) error {
+	return s.AppendBatch([][]byte{record})
+}
+
+// AppendBatch writes records to the log as a single file transaction
+// (one open, one set of writes, one close), so a tick's worth of
+// transitions lands together instead of one open/close per record.
+func (s *Store) AppendBatch(records [][]byte) error {
+	if len(records) == 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(s.logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for _, r := range records {
+		n, err := writeFrame(f, r)
+		s.logSize += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+	return f.Sync()
+}
+
+func writeFrame(w io.Writer, record []byte) (int, error) {
+	var hdr [4]byte
+	binary.BigEndian.PutUint32(hdr[:], uint32(len(record)))
+	crc := crc32.NewIEEE()
+	crc.Write(hdr[:])
+	crc.Write(record)
+	var trailer [4]byte
+	binary.BigEndian.PutUint32(trailer[:], crc.Sum32())
+
+	written := 0
+	for _, buf := range [][]byte{hdr[:], record, trailer[:]} {
+		n, err := w.Write(buf)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Snapshot atomically replaces the snapshot file with data, then
+// truncates the log: everything up to now is now represented in the
+// snapshot, so the log can start empty again.
+func (s *Store) Snapshot(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tmp := s.snapPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.snapPath); err != nil {
+		return err
+	}
+	s.snapSize = int64(len(data))
+	if err := os.Truncate(s.logPath, 0); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	s.logSize = 0
+	return nil
+}
+
+// minCompactBytes is a floor on logSize before ShouldCompact considers
+// compacting at all. Without it, a near-empty snapshot makes the 2x
+// ratio trivially true - e.g. a brand new store's snapSize is 0, so the
+// very first record ever appended would trigger compaction - defeating
+// the point of batching transitions instead of rewriting the whole
+// state every tick.
+const minCompactBytes = 64 * 1024
+
+// ShouldCompact reports whether the log has grown past twice the last
+// snapshot's size and is at least minCompactBytes long, the trigger for
+// opportunistic compaction.
+func (s *Store) ShouldCompact() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.logSize < minCompactBytes {
+		return false
+	}
+	return s.logSize > 2*s.snapSize
+}
+
+// Replay calls snapshot with the last compaction snapshot's bytes (if
+// any), then calls record with each log record appended since, in
+// order. A torn frame at the end of the log - a truncated length
+// prefix, body, trailer, or a CRC mismatch - is treated as evidence of
+// a crash mid-append: replay stops there without error and the log is
+// truncated to the last good frame boundary.
+func (s *Store) Replay(snapshot func([]byte) error, record func([]byte) error) error {
+	if data, err := os.ReadFile(s.snapPath); err == nil {
+		if err := snapshot(data); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	f, err := os.OpenFile(s.logPath, os.O_RDWR, 0644)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var offset int64
+	for {
+		var hdr [4]byte
+		if _, err := io.ReadFull(f, hdr[:]); err == io.EOF {
+			break
+		} else if err != nil {
+			break
+		}
+		n := binary.BigEndian.Uint32(hdr[:])
+		buf := make([]byte, n)
+		var trailer [4]byte
+		if _, err := io.ReadFull(f, buf); err != nil {
+			break
+		}
+		if _, err := io.ReadFull(f, trailer[:]); err != nil {
+			break
+		}
+		crc := crc32.NewIEEE()
+		crc.Write(hdr[:])
+		crc.Write(buf)
+		if crc.Sum32() != binary.BigEndian.Uint32(trailer[:]) {
+			break
+		}
+		offset += int64(4 + len(buf) + 4)
+		if err := record(buf); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := f.Truncate(offset); err != nil {
+		return err
+	}
+	s.logSize = offset
+	return nil
+}
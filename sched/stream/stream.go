@@ -0,0 +1,261 @@
+// Package stream implements a bounded, broadcast event buffer used to
+// stream alert state transitions (and acks, squelches, restores) to
+// subscribers such as the web UI or external integrations.
+//
+// The buffer is a linked list of items guarded by a mutex. Each item
+// carries a channel that is closed the moment the next item is
+// appended, so subscribers wake on a broadcast rather than being polled
+// or requiring a per-subscriber lock. Items older than the configured
+// size or TTL are evicted from the head; a subscriber that asks for an
+// index no longer retained, or that falls behind while reading, is sent
+// a TopicDropped sentinel and must resubscribe from the latest index
+// rather than block the producer.
+package stream
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/StackExchange/scollector/opentsdb"
+)
+
+// Topic identifies the kind of transition an Event represents.
+type Topic string
+
+const (
+	TopicAlert   Topic = "alert"   // alert status changed (State.Append)
+	TopicAck     Topic = "ack"     // alert was acknowledged
+	TopicSquelch Topic = "squelch" // alert was squelched
+	TopicRestore Topic = "restore" // state restored from disk at startup
+
+	// TopicDropped is delivered in place of real events when a
+	// subscriber's requested starting index has already been evicted,
+	// or when it falls too far behind the head to catch up.
+	TopicDropped Topic = "dropped"
+)
+
+// Event describes a single alert state transition.
+type Event struct {
+	Topic   Topic
+	Key     string // AlertKey.String(), or "<alert>:crit"/"<alert>:warn" for an expression that failed to evaluate
+	Name    string // alert name
+	Group   opentsdb.TagSet
+	Old     int // previous Status
+	New     int // new Status
+	Time    time.Time
+	Subject string
+}
+
+// Filter restricts a Subscription to a subset of Events. A zero Filter
+// matches everything.
+type Filter struct {
+	Topics []Topic
+	Name   string
+	Tags   opentsdb.TagSet // every key/value here must match the event's Group
+}
+
+func (f Filter) match(e Event) bool {
+	if len(f.Topics) > 0 {
+		var ok bool
+		for _, t := range f.Topics {
+			if t == e.Topic {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	if f.Name != "" && f.Name != e.Name {
+		return false
+	}
+	for k, v := range f.Tags {
+		if e.Group[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+const subscriberBuffer = 32
+
+// item is one link in the buffer's event chain.
+type item struct {
+	Event
+	idx     uint64
+	dropped bool
+	next    *item
+	readyCh chan struct{}
+}
+
+// Buffer is a bounded, broadcast ring of Events.
+type Buffer struct {
+	mu      sync.Mutex
+	head    *item // oldest node still referenced; a sentinel (idx 0) until the first Append
+	tail    *item // most recently appended item, or head if nothing appended yet
+	lastIdx uint64
+	size    int
+	maxSize int
+	ttl     time.Duration
+}
+
+// NewBuffer returns a Buffer that retains at most maxSize items, and
+// evicts any item older than ttl regardless of size. head and tail
+// start at a shared sentinel node (idx 0, no payload) so Subscribe
+// always has a real node to wait on, even before the first Append.
+func NewBuffer(maxSize int, ttl time.Duration) *Buffer {
+	sentinel := &item{readyCh: make(chan struct{})}
+	return &Buffer{head: sentinel, tail: sentinel, maxSize: maxSize, ttl: ttl}
+}
+
+// Append adds e to the buffer, stamping it with the current time if
+// unset, and returns its index.
+func (b *Buffer) Append(e Event) uint64 {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lastIdx++
+	it := &item{Event: e, idx: b.lastIdx, readyCh: make(chan struct{})}
+	prev := b.tail
+	prev.next = it
+	close(prev.readyCh)
+	b.tail = it
+	b.size++
+	b.evict()
+	return it.idx
+}
+
+// evict drops items from the head until the buffer is within maxSize
+// and ttl. Dropped items are kept in the chain (so subscribers still
+// walking them can advance) but their payload is cleared and flagged.
+// The sentinel (idx 0) carries no payload and is always skipped once
+// it has been superseded, regardless of size or ttl.
+func (b *Buffer) evict() {
+	cutoff := time.Now().Add(-b.ttl)
+	for b.head != b.tail {
+		if b.head.idx == 0 {
+			b.head = b.head.next
+			continue
+		}
+		if b.size <= b.maxSize && !b.head.Time.Before(cutoff) {
+			break
+		}
+		b.head.dropped = true
+		b.head.Event = Event{}
+		b.head = b.head.next
+		b.size--
+	}
+}
+
+// Subscription delivers Events matching a Filter to a consumer.
+type Subscription struct {
+	Events chan Event
+
+	done     chan struct{}
+	closeOne sync.Once
+}
+
+// Close stops delivery and releases the Subscription's goroutine.
+func (s *Subscription) Close() {
+	s.closeOne.Do(func() { close(s.done) })
+}
+
+// Subscribe registers filter against the buffer starting at since (0
+// means only events appended after this call). If since has already
+// been evicted, the first delivered event is a TopicDropped sentinel
+// followed by everything still retained.
+func (b *Buffer) Subscribe(ctx context.Context, filter Filter, since uint64) (*Subscription, error) {
+	b.mu.Lock()
+	var cur *item
+	var stale bool
+	if since == 0 {
+		// Start at the current tail: forward() only delivers items
+		// appended after cur, so this subscriber sees nothing but
+		// what's appended from now on.
+		cur = b.tail
+	} else {
+		cur = b.head
+		for cur.next != nil && cur.idx < since {
+			cur = cur.next
+		}
+		stale = cur.idx != since
+		if stale && cur.idx > since {
+			// since was evicted: forward only delivers items after
+			// cur, so start from a stand-in node just before the
+			// oldest retained item to deliver that item too.
+			cur = &item{idx: since, next: cur}
+		}
+	}
+	b.mu.Unlock()
+
+	sub := &Subscription{
+		Events: make(chan Event, subscriberBuffer),
+		done:   make(chan struct{}),
+	}
+	go b.forward(ctx, sub, cur, filter, stale)
+	return sub, nil
+}
+
+func (b *Buffer) forward(ctx context.Context, sub *Subscription, cur *item, filter Filter, stale bool) {
+	defer close(sub.Events)
+	if stale {
+		if !send(ctx, sub, Event{Topic: TopicDropped, Time: time.Now().UTC()}) {
+			return
+		}
+	}
+	for {
+		b.mu.Lock()
+		next := cur.next
+		b.mu.Unlock()
+		if next == nil {
+			select {
+			case <-cur.readyCh:
+			case <-ctx.Done():
+				return
+			case <-sub.done:
+				return
+			}
+			b.mu.Lock()
+			next = cur.next
+			b.mu.Unlock()
+		}
+		cur = next
+		// cur is reachable via .next, but evict can still be mutating
+		// its dropped/Event fields concurrently (it clears a node's
+		// payload in place rather than replacing it), so those reads
+		// need the same lock evict writes under.
+		b.mu.Lock()
+		dropped := cur.dropped
+		event := cur.Event
+		b.mu.Unlock()
+		if dropped {
+			if !send(ctx, sub, Event{Topic: TopicDropped, Time: time.Now().UTC()}) {
+				return
+			}
+			continue
+		}
+		if !filter.match(event) {
+			continue
+		}
+		if !send(ctx, sub, event) {
+			return
+		}
+	}
+}
+
+// send delivers e to sub.Events, returning false if the subscription
+// or context ended first.
+func send(ctx context.Context, sub *Subscription, e Event) bool {
+	select {
+	case sub.Events <- e:
+		return true
+	case <-ctx.Done():
+		return false
+	case <-sub.done:
+		return false
+	}
+}
@@ -0,0 +1,59 @@
+package stream
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// Subscribing with since=0 must only deliver events appended after the
+// call, not the backlog already retained in the buffer.
+func TestBufferSubscribeSinceZeroSkipsBacklog(t *testing.T) {
+	b := NewBuffer(100, time.Hour)
+	b.Append(Event{Name: "before1"})
+	b.Append(Event{Name: "before2"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sub, err := b.Subscribe(ctx, Filter{}, 0)
+	if err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	defer sub.Close()
+
+	b.Append(Event{Name: "after"})
+
+	select {
+	case e := <-sub.Events:
+		if e.Name != "after" {
+			t.Fatalf("got event %q, want %q (backlog leaked into a since=0 subscription)", e.Name, "after")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the post-subscribe event")
+	}
+}
+
+// A subscriber asking for an index that has already been evicted gets a
+// TopicDropped sentinel instead of silently missing data.
+func TestBufferSubscribeEvictedSinceIsStale(t *testing.T) {
+	b := NewBuffer(1, time.Hour)
+	first := b.Append(Event{Name: "first"})
+	b.Append(Event{Name: "second"}) // evicts "first" since maxSize is 1
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sub, err := b.Subscribe(ctx, Filter{}, first)
+	if err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	defer sub.Close()
+
+	select {
+	case e := <-sub.Events:
+		if e.Topic != TopicDropped {
+			t.Fatalf("got topic %q, want %q", e.Topic, TopicDropped)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the dropped sentinel")
+	}
+}